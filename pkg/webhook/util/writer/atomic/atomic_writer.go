@@ -19,11 +19,15 @@ package atomic
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"os"
 	"path"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -55,8 +59,13 @@ const (
 // Consumers of the target directory can monitor the ..data symlink using
 // inotify or fanotify to receive events when the content in the volume is
 // updated.
+//
+// When Options.Dedup is set, the timestamped directory is replaced by a
+// content-addressed directory so that Writers projecting identical payloads
+// (optionally sharing a central Options.CASRoot) reuse a single copy on disk.
 type Writer struct {
 	targetDir string
+	opts      Options
 }
 
 type FileProjection struct {
@@ -64,20 +73,79 @@ type FileProjection struct {
 	Mode int32
 }
 
+// Options configures optional behavior of a Writer beyond the default
+// timestamped-directory projection scheme.
+type Options struct {
+	// CASRoot, when non-empty, is the directory under which content-addressed
+	// (..cas_<digest>) directories are created instead of under the Writer's
+	// target directory. This allows multiple Writers, each projecting into a
+	// different target directory, to share a single on-disk copy of identical
+	// content. It is only consulted when Dedup is true.
+	CASRoot string
+
+	// Dedup switches the Writer from timestamped directories to
+	// content-addressable (..cas_<digest>) directories, so that a Write whose
+	// payload is byte-identical to content already on disk can skip writing
+	// the payload and simply repoint ..data at the existing directory.
+	Dedup bool
+
+	// KeepGenerations is the number of past generations (including the
+	// current one) to retain on disk instead of removing as soon as they are
+	// superseded. A value <= 1 preserves the original behavior of removing
+	// the previous generation as soon as the new one is in place. Retained
+	// generations are tracked in ..history.json and can be restored with
+	// Writer.Rollback.
+	KeepGenerations int
+
+	// LeafSymlinks switches createUserVisibleFiles from symlinking the first
+	// path component of each payload entry to symlinking each leaf file
+	// individually. This lets a Writer project into a target directory that
+	// already contains user-owned subdirectories, instead of requiring
+	// exclusive ownership of the top-level directory for every projected
+	// path. See createLeafSymlinks for details.
+	//
+	// It also changes how step 11 of Write's cleanup behaves: instead of
+	// removing only top-level symlinks, removeUserVisiblePaths delegates to
+	// removeLeafSymlinks, which removes leaf symlinks individually and prunes
+	// the directories left empty behind them, without descending into (or
+	// removing) any non-symlink content a caller owns.
+	LeafSymlinks bool
+}
+
+// WriteOptions carries metadata about a single Write call that isn't part of
+// the payload itself, currently just an operator-facing label recorded
+// alongside the generation in history.
+type WriteOptions struct {
+	// Author identifies who or what produced this generation, e.g. a
+	// controller name or a reconcile trigger. It is surfaced through
+	// Writer.History and is purely informational.
+	Author string
+}
+
 // NewAtomicWriter creates a new Writer configured to write to the given
 // target directory, or returns an error if the target directory does not exist.
 func NewAtomicWriter(targetDir string) (*Writer, error) {
+	return NewAtomicWriterWithOptions(targetDir, Options{})
+}
+
+// NewAtomicWriterWithOptions creates a new Writer configured to write to the
+// given target directory with the given Options, or returns an error if the
+// target directory does not exist.
+func NewAtomicWriterWithOptions(targetDir string, opts Options) (*Writer, error) {
 	_, err := os.Stat(targetDir)
 	if os.IsNotExist(err) {
 		return nil, err
 	}
 
-	return &Writer{targetDir: targetDir}, nil
+	return &Writer{targetDir: targetDir, opts: opts}, nil
 }
 
 const (
 	dataDirName    = "..data"
 	newDataDirName = "..data_tmp"
+	casDirPrefix   = "..cas_"
+	casRefsName    = ".refs"
+	casLockName    = ".refs.lock"
 )
 
 // Write does an atomic projection of the given payload into the writer's target
@@ -112,13 +180,40 @@ const (
 //     The data directory itself is a link to a timestamped directory with
 //     the real data:
 //     <target-dir>/..data          -> ..2016_02_01_15_04_05.12345678/
-//     8.  A symlink to the new timestamped directory ..data_tmp is created that will
+//     8.  setPerms, if non-nil, is invoked on the new timestamped directory so
+//     that ownership and mode are fully applied before the directory can be
+//     observed through the ..data symlink
+//     9.  A symlink to the new timestamped directory ..data_tmp is created that will
 //     become the new data directory
-//     9.  The new data directory symlink is renamed to the data directory; rename is atomic
+// 10.  The new data directory symlink is renamed to the data directory; rename is atomic
+//
+// 11.  Old paths are removed from the user-visible portion of the target directory
+// 12.  This generation is recorded in ..history.json; the previous timestamped
+//      directory, and any generation beyond the configured retention, are removed
 //
-// 10.  Old paths are removed from the user-visible portion of the target directory
-// 11.  The previous timestamped directory is removed, if it exists
-func (w *Writer) Write(payload map[string]FileProjection) error {
+// setPerms runs on the timestamped directory after its contents are written but
+// before the ..data symlink can be repointed to it, so it can be used to
+// chown/chmod the projected files without a window in which a consumer could
+// observe content with the wrong ownership or mode. It may be nil, in which
+// case no additional permission fixup is performed. If setPerms returns an
+// error, the timestamped directory is removed and the write is aborted.
+//
+// setPerms is not supported together with Options.Dedup: a content-addressed
+// directory may be physically shared on disk with other Writers (via a
+// common Options.CASRoot) or reused by a later Write of this Writer, so
+// mutating its ownership/mode in place would silently change permissions
+// out from under every other Writer/generation sharing it. Write returns an
+// error immediately if both are set.
+//
+// writeOpts.Author, if set, is recorded alongside this generation in
+// ..history.json for later inspection via Writer.History.
+func (w *Writer) Write(payload map[string]FileProjection, setPerms func(tsDir string) error, writeOpts WriteOptions) error {
+	if w.opts.Dedup && setPerms != nil {
+		err := fmt.Errorf("setPerms is not supported together with Options.Dedup: a content-addressed directory may be shared by other Writers, so one Writer's setPerms would silently change permissions for all of them")
+		klog.Error(err, "setPerms used together with Dedup", "target directory", w.targetDir)
+		return err
+	}
+
 	// (1)
 	cleanPayload, err := validatePayload(payload)
 	if err != nil {
@@ -138,7 +233,7 @@ func (w *Writer) Write(payload map[string]FileProjection) error {
 		// empty oldTsDir indicates that it didn't exist
 		oldTsDir = ""
 	}
-	oldTsPath := path.Join(w.targetDir, oldTsDir)
+	oldTsPath := w.resolveTsPath(oldTsDir)
 
 	var pathsToRemove sets.Set[string]
 	// if there was no old version, there's nothing to remove
@@ -162,20 +257,30 @@ func (w *Writer) Write(payload map[string]FileProjection) error {
 		}
 	}
 
-	// (5)
-	tsDir, err := w.newTimestampDir()
-	if err != nil {
-		klog.Error(err, "error creating new ts data directory")
-		return err
-	}
-	tsDirName := filepath.Base(tsDir)
+	// (5) / (6)
+	var tsDir string
+	var dataDirTarget string
+	var reusedCASDir bool
+	if w.opts.Dedup {
+		tsDir, dataDirTarget, reusedCASDir, err = w.casDir(cleanPayload)
+		if err != nil {
+			klog.Error(err, "error preparing content-addressed data directory")
+			return err
+		}
+	} else {
+		tsDir, err = w.newTimestampDir()
+		if err != nil {
+			klog.Error(err, "error creating new ts data directory")
+			return err
+		}
+		dataDirTarget = filepath.Base(tsDir)
 
-	// (6)
-	if err = w.writePayloadToDir(cleanPayload, tsDir); err != nil {
-		klog.Error(err, "unable to write payload to ts data directory", "ts directory", tsDir)
-		return err
+		if err = w.writePayloadToDir(cleanPayload, tsDir); err != nil {
+			klog.Error(err, "unable to write payload to ts data directory", "ts directory", tsDir)
+			return err
+		}
+		klog.V(1).Info("performed write of new data to ts data directory", "ts directory", tsDir)
 	}
-	klog.V(1).Info("performed write of new data to ts data directory", "ts directory", tsDir)
 
 	// (7)
 	if err = w.createUserVisibleFiles(cleanPayload); err != nil {
@@ -184,40 +289,49 @@ func (w *Writer) Write(payload map[string]FileProjection) error {
 	}
 
 	// (8)
+	if setPerms != nil {
+		if err = setPerms(tsDir); err != nil {
+			w.abortTsDir(tsDir, reusedCASDir)
+			klog.Error(err, "unable to apply permissions to ts data directory", "ts directory", tsDir)
+			return err
+		}
+		klog.V(1).Info("applied permissions to ts data directory", "ts directory", tsDir)
+	}
+
+	// (9)
 	newDataDirPath := path.Join(w.targetDir, newDataDirName)
-	if err = os.Symlink(tsDirName, newDataDirPath); err != nil {
-		os.RemoveAll(tsDir)
+	if err = os.Symlink(dataDirTarget, newDataDirPath); err != nil {
+		w.abortTsDir(tsDir, reusedCASDir)
 		klog.Error(err, "unable to create symbolic link for atomic update")
 		return err
 	}
 
-	// (9)
+	// (10)
 	if runtime.GOOS == "windows" {
 		os.Remove(dataDirPath)
-		err = os.Symlink(tsDirName, dataDirPath)
+		err = os.Symlink(dataDirTarget, dataDirPath)
 		os.Remove(newDataDirPath)
 	} else {
 		err = os.Rename(newDataDirPath, dataDirPath)
 	}
 	if err != nil {
 		os.Remove(newDataDirPath)
-		os.RemoveAll(tsDir)
+		w.abortTsDir(tsDir, reusedCASDir)
 		klog.Error(err, "unable to rename symbolic link for data directory", "data directory", newDataDirPath)
 		return err
 	}
 
-	// (10)
+	// (11)
 	if err = w.removeUserVisiblePaths(pathsToRemove); err != nil {
 		klog.Error(err, "unable to remove old visible symlinks")
 		return err
 	}
 
-	// (11)
-	if len(oldTsDir) > 0 {
-		if err = os.RemoveAll(oldTsPath); err != nil {
-			klog.Error(err, "unable to remove old data directory", "data directory", oldTsDir)
-			return err
-		}
+	// (12)
+	digest := computeDigest(cleanPayload)
+	if err = w.recordAndPrune(oldTsDir, filepath.Base(tsDir), digest, writeOpts.Author, false); err != nil {
+		klog.Error(err, "unable to record write history", "target directory", w.targetDir)
+		return err
 	}
 
 	return nil
@@ -316,7 +430,7 @@ func (w *Writer) pathsToRemove(payload map[string]FileProjection, oldTsDir strin
 	visitor := func(path string, info os.FileInfo, err error) error {
 		relativePath := strings.TrimPrefix(path, oldTsDir)
 		relativePath = strings.TrimPrefix(relativePath, string(os.PathSeparator))
-		if relativePath == "" {
+		if relativePath == "" || relativePath == casRefsName || relativePath == casLockName {
 			return nil
 		}
 
@@ -370,6 +484,253 @@ func (w *Writer) newTimestampDir() (string, error) {
 	return tsDir, nil
 }
 
+// casRootDir returns the directory under which content-addressed (..cas_*)
+// directories are created, which is the Writer's target directory unless a
+// central CASRoot has been configured for sharing content across Writers.
+func (w *Writer) casRootDir() string {
+	if w.opts.CASRoot != "" {
+		return w.opts.CASRoot
+	}
+	return w.targetDir
+}
+
+// casDir prepares the content-addressed directory for the given payload,
+// writing it if it doesn't already exist or reusing it (and bumping its
+// refcount) if an identical one is already on disk. It returns the directory
+// that holds the payload's content, the value that should be used as the
+// ..data symlink target, and whether an existing directory was reused. The
+// directory (and its refcount file) may be shared by other Writers pointed
+// at the same CASRoot, so the whole existence-check/write/refcount sequence
+// runs under an exclusive lock on that directory's refs file to avoid
+// concurrent Writers tearing each other's refcount updates.
+func (w *Writer) casDir(payload map[string]FileProjection) (dir string, dataDirTarget string, reused bool, err error) {
+	digest := computeDigest(payload)
+	root := w.casRootDir()
+	name := casDirPrefix + digest
+	dir = path.Join(root, name)
+
+	// The refs lock file lives inside dir, so dir must exist before it can be
+	// locked; MkdirAll is a cheap no-op if another Writer already created it.
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		klog.Error(err, "unable to create content-addressed directory", "directory", dir)
+		return "", "", false, err
+	}
+
+	unlock, err := lockRefsFile(dir)
+	if err != nil {
+		klog.Error(err, "unable to lock content-addressed directory", "directory", dir)
+		return "", "", false, err
+	}
+	defer unlock()
+
+	if _, statErr := os.Lstat(refsPath(dir)); statErr == nil {
+		// A refs file only exists once a previous Writer has fully committed
+		// its payload, so this directory already holds committed content.
+		ok, verifyErr := verifyCASDir(dir, payload)
+		if verifyErr != nil {
+			klog.Error(verifyErr, "unable to verify existing content-addressed directory", "directory", dir)
+			return "", "", false, verifyErr
+		}
+		if ok {
+			if err = incrementRefCount(dir); err != nil {
+				klog.Error(err, "unable to increment refcount for content-addressed directory", "directory", dir)
+				return "", "", false, err
+			}
+			klog.V(1).Info("reusing existing content-addressed directory", "directory", dir)
+			return dir, w.casDataDirTarget(dir), true, nil
+		}
+		// A directory with the same digest exists but doesn't match the
+		// payload; this should not happen absent a hash collision or a
+		// corrupted on-disk directory, so fail loudly rather than overwrite it.
+		return "", "", false, fmt.Errorf("content-addressed directory %s exists but does not match its payload", dir)
+	} else if !os.IsNotExist(statErr) {
+		return "", "", false, statErr
+	}
+
+	if err = w.writePayloadToDir(payload, dir); err != nil {
+		os.RemoveAll(dir)
+		klog.Error(err, "unable to write payload to content-addressed directory", "directory", dir)
+		return "", "", false, err
+	}
+	if err = writeRefCount(dir, 1); err != nil {
+		os.RemoveAll(dir)
+		klog.Error(err, "unable to initialize refcount for content-addressed directory", "directory", dir)
+		return "", "", false, err
+	}
+	klog.V(1).Info("wrote new content-addressed directory", "directory", dir)
+	return dir, w.casDataDirTarget(dir), false, nil
+}
+
+// casDataDirTarget returns the value the ..data symlink should point at for a
+// content-addressed directory: a bare directory name when it lives alongside
+// the target directory (so the link stays relative), or an absolute path when
+// it lives under a separately configured CASRoot.
+func (w *Writer) casDataDirTarget(dir string) string {
+	if w.opts.CASRoot != "" {
+		return dir
+	}
+	return filepath.Base(dir)
+}
+
+// resolveTsPath resolves a value read back from the ..data symlink (oldTsDir)
+// to an absolute/on-disk path: such values are either a bare directory name
+// relative to the target directory, or (for a content-addressed directory
+// under a separately configured CASRoot) already an absolute path.
+func (w *Writer) resolveTsPath(tsDirOrPath string) string {
+	return resolveDataDirTarget(w.targetDir, tsDirOrPath)
+}
+
+// resolveDataDirTarget resolves a ..data symlink target read back from disk
+// to an absolute path, given the directory the symlink lives in. It is
+// shared by Writer (via resolveTsPath) and Watcher, which both need to
+// handle a content-addressed generation living under a separately
+// configured CASRoot rather than alongside the target directory.
+func resolveDataDirTarget(targetDir, tsDirOrPath string) string {
+	if filepath.IsAbs(tsDirOrPath) {
+		return tsDirOrPath
+	}
+	return path.Join(targetDir, tsDirOrPath)
+}
+
+// abortTsDir cleans up a ts directory after a failed Write. Freshly created
+// directories are removed outright; a reused content-addressed directory may
+// still be referenced by other Writers, so it is only released through the
+// refcount.
+func (w *Writer) abortTsDir(tsDir string, reused bool) {
+	if reused {
+		unlock, err := lockRefsFile(tsDir)
+		if err != nil {
+			klog.Error(err, "unable to lock content-addressed directory for release", "directory", tsDir)
+			return
+		}
+		defer unlock()
+		if err := decrementRefCount(tsDir); err != nil {
+			klog.Error(err, "unable to release content-addressed directory after aborted write", "directory", tsDir)
+		}
+		return
+	}
+	os.RemoveAll(tsDir)
+}
+
+// releaseOldTsDir removes the previous ts directory that a Write is replacing
+// in the target directory, taking the shared refcount into account when the
+// directory is content-addressed. The refcount read-modify-write is guarded
+// by the directory's refs lock so concurrent Writers sharing a CASRoot don't
+// tear each other's updates.
+func (w *Writer) releaseOldTsDir(oldTsPath string) error {
+	if strings.HasPrefix(filepath.Base(oldTsPath), casDirPrefix) {
+		unlock, err := lockRefsFile(oldTsPath)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+		return decrementRefCount(oldTsPath)
+	}
+	return os.RemoveAll(oldTsPath)
+}
+
+// computeDigest produces a stable content hash for a payload: it sorts the
+// payload's paths and feeds each entry's path, mode, length and data through
+// sha256, so that two byte-identical payloads always hash to the same value
+// regardless of map iteration order.
+func computeDigest(payload map[string]FileProjection) string {
+	paths := make([]string, 0, len(payload))
+	for p := range payload {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	h := sha256.New()
+	for _, p := range paths {
+		fp := payload[p]
+		fmt.Fprintf(h, "%s\x00%d\x00%d\x00", p, fp.Mode, len(fp.Data))
+		h.Write(fp.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// verifyCASDir reports whether the content-addressed directory at dir holds
+// exactly the file set in payload, with matching sizes and modes. It is a
+// quick structural check, not a byte-for-byte re-hash, since the directory
+// name already commits to the content digest.
+func verifyCASDir(dir string, payload map[string]FileProjection) (bool, error) {
+	seen := sets.New[string]()
+	walkErr := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || info.IsDir() {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(p, dir)
+		relativePath = strings.TrimPrefix(relativePath, string(os.PathSeparator))
+		if relativePath == casRefsName || relativePath == casLockName {
+			return nil
+		}
+
+		fp, ok := payload[relativePath]
+		if !ok || info.Size() != int64(len(fp.Data)) || info.Mode().Perm() != os.FileMode(fp.Mode).Perm() {
+			return fmt.Errorf("mismatch at %s", relativePath)
+		}
+		seen.Insert(relativePath)
+		return nil
+	})
+	if walkErr != nil {
+		if os.IsNotExist(walkErr) {
+			return false, nil
+		}
+		// a mismatch reported above is not a real I/O error; treat it as "not a match"
+		return false, nil
+	}
+
+	return seen.Len() == len(payload), nil
+}
+
+// refsPath returns the path of the shared refcount file for a
+// content-addressed directory.
+func refsPath(dir string) string {
+	return path.Join(dir, casRefsName)
+}
+
+// readRefCount returns the current refcount recorded for a content-addressed
+// directory.
+func readRefCount(dir string) (int, error) {
+	data, err := os.ReadFile(refsPath(dir))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// writeRefCount sets the refcount recorded for a content-addressed directory.
+func writeRefCount(dir string, n int) error {
+	return os.WriteFile(refsPath(dir), []byte(strconv.Itoa(n)), 0644)
+}
+
+// incrementRefCount bumps the refcount for a content-addressed directory that
+// is being reused by an additional Writer.
+func incrementRefCount(dir string) error {
+	n, err := readRefCount(dir)
+	if err != nil {
+		return err
+	}
+	return writeRefCount(dir, n+1)
+}
+
+// decrementRefCount drops the refcount for a content-addressed directory by
+// one and removes the directory once nothing references it any longer.
+func decrementRefCount(dir string) error {
+	n, err := readRefCount(dir)
+	if err != nil {
+		return err
+	}
+	n--
+	if n <= 0 {
+		return os.RemoveAll(dir)
+	}
+	return writeRefCount(dir, n)
+}
+
 // writePayloadToDir writes the given payload to the given directory.  The
 // directory must exist.
 func (w *Writer) writePayloadToDir(payload map[string]FileProjection, dir string) error {
@@ -413,7 +774,14 @@ func (w *Writer) writePayloadToDir(payload map[string]FileProjection, dir string
 // bar -> ..data/bar
 // foo -> ..data/foo
 // baz -> ..data/baz
+//
+// When Options.LeafSymlinks is set, createLeafSymlinks is used instead, which
+// symlinks each leaf file rather than its top-level directory.
 func (w *Writer) createUserVisibleFiles(payload map[string]FileProjection) error {
+	if w.opts.LeafSymlinks {
+		return w.createLeafSymlinks(payload)
+	}
+
 	for userVisiblePath := range payload {
 		slashpos := strings.Index(userVisiblePath, string(os.PathSeparator))
 		if slashpos == -1 {
@@ -437,7 +805,15 @@ func (w *Writer) createUserVisibleFiles(payload map[string]FileProjection) error
 
 // removeUserVisiblePaths removes the set of paths from the user-visible
 // portion of the writer's target directory.
+//
+// When Options.LeafSymlinks is set, removeLeafSymlinks is used instead, which
+// removes leaf symlinks and the now-empty parent directories they leave
+// behind, rather than top-level symlinks.
 func (w *Writer) removeUserVisiblePaths(paths sets.Set[string]) error {
+	if w.opts.LeafSymlinks {
+		return w.removeLeafSymlinks(paths)
+	}
+
 	ps := string(os.PathSeparator)
 	var lasterr error
 	for p := range paths {
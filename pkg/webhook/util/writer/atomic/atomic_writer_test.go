@@ -0,0 +1,122 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestWriteSetPermsAppliedBeforeObservable continuously walks the target
+// directory's ..data symlink on a background goroutine while a Write runs
+// with a slow setPerms, asserting that every file observed through ..data
+// already has its final mode applied - never an intermediate one. This is
+// the scenario setPerms exists to close: a consumer reading through ..data
+// must never see content before its permissions are fixed up.
+func TestWriteSetPermsAppliedBeforeObservable(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriter(targetDir)
+	if err != nil {
+		t.Fatalf("NewAtomicWriter: %v", err)
+	}
+
+	payload := map[string]FileProjection{
+		"config.yaml": {Data: []byte("replicas: 3\n"), Mode: 0640},
+	}
+
+	var mismatches atomic.Int32
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			data, err := os.ReadFile(path.Join(targetDir, "config.yaml"))
+			if err != nil {
+				continue
+			}
+			if len(data) == 0 {
+				continue
+			}
+			info, err := os.Stat(path.Join(targetDir, "config.yaml"))
+			if err != nil {
+				continue
+			}
+			if info.Mode().Perm() != 0640 {
+				mismatches.Add(1)
+			}
+		}
+	}()
+
+	setPerms := func(tsDir string) error {
+		// simulate a slow chown/chmod pass to widen the window a racy
+		// implementation would expose
+		time.Sleep(20 * time.Millisecond)
+		return os.Chmod(path.Join(tsDir, "config.yaml"), 0640)
+	}
+
+	if err := w.Write(payload, setPerms, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if n := mismatches.Load(); n != 0 {
+		t.Fatalf("observed %d reads of config.yaml with the wrong mode before setPerms completed", n)
+	}
+}
+
+// TestWriteSetPermsErrorAbortsWrite asserts that a setPerms error removes the
+// timestamped directory and leaves the target directory's ..data untouched.
+func TestWriteSetPermsErrorAbortsWrite(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriter(targetDir)
+	if err != nil {
+		t.Fatalf("NewAtomicWriter: %v", err)
+	}
+
+	payload := map[string]FileProjection{"a": {Data: []byte("a"), Mode: 0644}}
+	boom := os.ErrPermission
+	if err := w.Write(payload, func(string) error { return boom }, WriteOptions{}); err == nil {
+		t.Fatal("expected Write to fail when setPerms errors")
+	}
+
+	if _, err := os.Lstat(path.Join(targetDir, dataDirName)); !os.IsNotExist(err) {
+		t.Fatalf("expected no ..data symlink after aborted write, got err=%v", err)
+	}
+
+	entries, err := os.ReadDir(targetDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	for _, e := range entries {
+		if strings.HasPrefix(e.Name(), "..2") {
+			t.Fatalf("expected aborted write to remove its timestamped directory, found %q", e.Name())
+		}
+	}
+}
@@ -0,0 +1,161 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// TestCASDedupRejectsSetPerms is a regression test for Write silently
+// skipping setPerms whenever it reused an existing content-addressed
+// directory, which let the first Writer to populate a shared CAS entry
+// permanently decide its ownership/mode - every later Writer reusing that
+// entry via dedup silently kept the first Writer's permissions instead of
+// applying its own. Since a content-addressed directory may be physically
+// shared with other Writers (or reused by a later generation of this same
+// Writer), running setPerms on it in place would just move the bug from
+// "skipped" to "mutates permissions out from under every other sharer", so
+// Write now fails fast instead when Dedup and setPerms are used together.
+func TestCASDedupRejectsSetPerms(t *testing.T) {
+	root := t.TempDir()
+	casRoot := path.Join(root, "cas")
+	payload := map[string]FileProjection{
+		"config.yaml": {Data: []byte("replicas: 3\n"), Mode: 0644},
+	}
+
+	target := path.Join(root, "target-1")
+	os.MkdirAll(target, 0755)
+
+	w, err := NewAtomicWriterWithOptions(target, Options{Dedup: true, CASRoot: casRoot})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+	setPerms := func(tsDir string) error {
+		return os.Chmod(path.Join(tsDir, "config.yaml"), 0640)
+	}
+	if err := w.Write(payload, setPerms, WriteOptions{}); err == nil {
+		t.Fatal("expected Write to reject setPerms combined with Dedup, got nil error")
+	}
+}
+
+// TestCASDedupConcurrentWriters writes an identical payload from several
+// Writers sharing a CASRoot concurrently, asserting that every Write
+// succeeds and the shared .refs file ends up with the correct count instead
+// of a torn read-modify-write of the refcount.
+func TestCASDedupConcurrentWriters(t *testing.T) {
+	root := t.TempDir()
+	casRoot := path.Join(root, "cas")
+	payload := map[string]FileProjection{
+		"config.yaml": {Data: []byte("replicas: 3\n"), Mode: 0644},
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := path.Join(root, fmt.Sprintf("target-%d", i))
+			if err := os.MkdirAll(target, 0755); err != nil {
+				errs[i] = err
+				return
+			}
+			w, err := NewAtomicWriterWithOptions(target, Options{Dedup: true, CASRoot: casRoot})
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			errs[i] = w.Write(payload, nil, WriteOptions{})
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("writer %d: %v", i, err)
+		}
+	}
+
+	entries, err := os.ReadDir(casRoot)
+	if err != nil {
+		t.Fatalf("ReadDir(casRoot): %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected a single shared content-addressed directory, found %d", len(entries))
+	}
+
+	got, err := readRefCount(path.Join(casRoot, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("readRefCount: %v", err)
+	}
+	if got != n {
+		t.Fatalf("expected refcount %d, got %d", n, got)
+	}
+}
+
+// TestCASDedupReuseSkipsRewrite asserts that writing an identical payload
+// from a second Writer reuses the existing content-addressed directory
+// instead of writing the payload again, and bumps its refcount to 2.
+func TestCASDedupReuseSkipsRewrite(t *testing.T) {
+	root := t.TempDir()
+	casRoot := path.Join(root, "cas")
+	payload := map[string]FileProjection{
+		"config.yaml": {Data: []byte("replicas: 3\n"), Mode: 0644},
+	}
+
+	target1 := path.Join(root, "target-1")
+	target2 := path.Join(root, "target-2")
+	os.MkdirAll(target1, 0755)
+	os.MkdirAll(target2, 0755)
+
+	w1, err := NewAtomicWriterWithOptions(target1, Options{Dedup: true, CASRoot: casRoot})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+	if err := w1.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("first Write: %v", err)
+	}
+
+	w2, err := NewAtomicWriterWithOptions(target2, Options{Dedup: true, CASRoot: casRoot})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+	if err := w2.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("second Write: %v", err)
+	}
+
+	entries, err := os.ReadDir(casRoot)
+	if err != nil {
+		t.Fatalf("ReadDir(casRoot): %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("expected both writers to share one content-addressed directory, found %d", len(entries))
+	}
+
+	got, err := readRefCount(path.Join(casRoot, entries[0].Name()))
+	if err != nil {
+		t.Fatalf("readRefCount: %v", err)
+	}
+	if got != 2 {
+		t.Fatalf("expected refcount 2 after the second writer reused the directory, got %d", got)
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+const historyFileName = "..history.json"
+
+// Generation describes one past or present ..data target recorded by a
+// Writer, as listed in ..history.json (newest first).
+type Generation struct {
+	// Name is the timestamped or content-addressed directory name this
+	// generation's content lives in, relative to the Writer's target
+	// directory (or CASRoot, for a content-addressed entry).
+	Name string `json:"name"`
+	// Timestamp is when this generation was recorded.
+	Timestamp time.Time `json:"timestamp"`
+	// Digest is the payload digest computed the same way as the CAS dedup
+	// feature, useful for spotting that two generations are identical.
+	Digest string `json:"digest"`
+	// Author is the caller-supplied WriteOptions.Author for this generation,
+	// or empty if none was given.
+	Author string `json:"author,omitempty"`
+	// Rollback is true if this generation was produced by Writer.Rollback
+	// rather than Writer.Write.
+	Rollback bool `json:"rollback,omitempty"`
+}
+
+// keepGenerations returns the effective number of generations this Writer
+// retains, defaulting to 1 (the original remove-the-previous-one behavior)
+// when Options.KeepGenerations is unset.
+func (w *Writer) keepGenerations() int {
+	if w.opts.KeepGenerations <= 0 {
+		return 1
+	}
+	return w.opts.KeepGenerations
+}
+
+func (w *Writer) historyPath() string {
+	return path.Join(w.targetDir, historyFileName)
+}
+
+// generationDir resolves a generation's Name to the directory it lives in:
+// under the Writer's CASRoot for a content-addressed generation (when
+// configured), or under the Writer's target directory otherwise.
+func (w *Writer) generationDir(name string) string {
+	if strings.HasPrefix(name, casDirPrefix) {
+		return path.Join(w.casRootDir(), name)
+	}
+	return path.Join(w.targetDir, name)
+}
+
+// loadHistory reads ..history.json, returning an empty (not nil-error) list
+// if the file doesn't exist yet or is corrupt. A corrupt history file is not
+// treated as fatal: it means past generations beyond the current one can no
+// longer be accounted for, but the Writer itself can keep operating.
+func (w *Writer) loadHistory() ([]Generation, error) {
+	data, err := os.ReadFile(w.historyPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var gens []Generation
+	if err := json.Unmarshal(data, &gens); err != nil {
+		klog.Error(err, "ignoring corrupt history file", "path", w.historyPath())
+		return nil, nil
+	}
+	return gens, nil
+}
+
+func (w *Writer) saveHistory(gens []Generation) error {
+	data, err := json.MarshalIndent(gens, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(w.historyPath(), data, 0644)
+}
+
+// recordAndPrune appends a new generation to ..history.json (newest first),
+// then removes whichever directories fall outside the Writer's configured
+// retention: the directory the ..data symlink previously pointed at
+// (oldTsDir), plus any generation already in history beyond keepGenerations.
+// Directories are released through releaseOldTsDir/decrementRefCount so that
+// content-addressed directories still referenced elsewhere are left alone.
+func (w *Writer) recordAndPrune(oldTsDir, name, digest, author string, rollback bool) error {
+	gens, err := w.loadHistory()
+	if err != nil {
+		return err
+	}
+
+	gens = append([]Generation{{
+		Name:      name,
+		Timestamp: time.Now().UTC(),
+		Digest:    digest,
+		Author:    author,
+		Rollback:  rollback,
+	}}, gens...)
+
+	// The generation being recorded may already appear in the loaded history
+	// (e.g. rolling back to, or re-writing, a still-retained generation).
+	// Dedup by Name, keeping the fresh entry (which sorts first), so the same
+	// on-disk directory is never counted twice - once as the generation
+	// ..data now points at and once as a "past" generation to be pruned.
+	seen := sets.New[string]()
+	deduped := make([]Generation, 0, len(gens))
+	for _, g := range gens {
+		if seen.Has(g.Name) {
+			continue
+		}
+		seen.Insert(g.Name)
+		deduped = append(deduped, g)
+	}
+	gens = deduped
+
+	keep := w.keepGenerations()
+	var pruned []Generation
+	if len(gens) > keep {
+		pruned = append(pruned, gens[keep:]...)
+		gens = gens[:keep]
+	}
+
+	if err := w.saveHistory(gens); err != nil {
+		return err
+	}
+
+	kept := sets.New[string]()
+	for _, g := range gens {
+		kept.Insert(g.Name)
+	}
+
+	// oldTsDir, as read back from the ..data symlink, is a bare directory
+	// name unless it's a content-addressed directory living under a
+	// separately configured CASRoot, in which case it's already an absolute
+	// path; normalize to the bare name to compare against recorded Generation
+	// names.
+	//
+	// oldTsDir's generation is typically also present in pruned (it just
+	// fell out of the retained window), so track what's already been
+	// released here to avoid releasing the same directory twice - for a
+	// content-addressed directory a second release would double-decrement
+	// an already-removed refs file instead of a harmless no-op RemoveAll.
+	released := sets.New[string]()
+	oldTsName := filepath.Base(oldTsDir)
+	if len(oldTsDir) > 0 && !kept.Has(oldTsName) {
+		if err := w.releaseOldTsDir(w.resolveTsPath(oldTsDir)); err != nil {
+			return err
+		}
+		released.Insert(oldTsName)
+	}
+	for _, g := range pruned {
+		// kept is guaranteed disjoint from pruned after the dedup above, but
+		// the check is cheap insurance against releasing a directory that's
+		// still referenced by the retained history.
+		if kept.Has(g.Name) || released.Has(g.Name) {
+			continue
+		}
+		if err := w.releaseOldTsDir(w.generationDir(g.Name)); err != nil {
+			return err
+		}
+		released.Insert(g.Name)
+	}
+
+	return nil
+}
+
+// History returns the Writer's recorded generations, newest first, as
+// tracked in ..history.json. It is only populated once Options.KeepGenerations
+// retains more than the current generation, or after a Rollback.
+func (w *Writer) History() ([]Generation, error) {
+	return w.loadHistory()
+}
+
+// Rollback atomically repoints ..data at a previously-recorded generation,
+// using the same ..data_tmp symlink-then-rename dance as Write. generation
+// must name a directory that still exists under the Writer's target
+// directory (typically one returned by History).
+func (w *Writer) Rollback(generation string) error {
+	genDir := w.generationDir(generation)
+	dataDirTarget := generation
+	if strings.HasPrefix(generation, casDirPrefix) {
+		dataDirTarget = w.casDataDirTarget(genDir)
+	}
+	info, err := os.Stat(genDir)
+	if err != nil {
+		return fmt.Errorf("rollback target %q does not exist under %s: %w", generation, w.targetDir, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("rollback target %q is not a directory", generation)
+	}
+
+	payload, err := readPayloadFromDir(genDir)
+	if err != nil {
+		klog.Error(err, "unable to read payload for rollback", "generation", generation)
+		return err
+	}
+
+	dataDirPath := path.Join(w.targetDir, dataDirName)
+	oldTsDir, err := os.Readlink(dataDirPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Error(err, "unable to read link for data directory")
+			return err
+		}
+		oldTsDir = ""
+	}
+
+	var pathsToRemove sets.Set[string]
+	if len(oldTsDir) != 0 {
+		pathsToRemove, err = w.pathsToRemove(payload, w.resolveTsPath(oldTsDir))
+		if err != nil {
+			klog.Error(err, "unable to determine user-visible files to remove for rollback")
+			return err
+		}
+	}
+
+	if err = w.createUserVisibleFiles(payload); err != nil {
+		klog.Error(err, "unable to create visible symlinks in target directory", "target directory", w.targetDir)
+		return err
+	}
+
+	newDataDirPath := path.Join(w.targetDir, newDataDirName)
+	if err = os.Symlink(dataDirTarget, newDataDirPath); err != nil {
+		klog.Error(err, "unable to create symbolic link for rollback")
+		return err
+	}
+
+	if runtime.GOOS == "windows" {
+		os.Remove(dataDirPath)
+		err = os.Symlink(dataDirTarget, dataDirPath)
+		os.Remove(newDataDirPath)
+	} else {
+		err = os.Rename(newDataDirPath, dataDirPath)
+	}
+	if err != nil {
+		os.Remove(newDataDirPath)
+		klog.Error(err, "unable to rename symbolic link for data directory during rollback", "data directory", newDataDirPath)
+		return err
+	}
+
+	if err = w.removeUserVisiblePaths(pathsToRemove); err != nil {
+		klog.Error(err, "unable to remove old visible symlinks during rollback")
+		return err
+	}
+
+	digest := computeDigest(payload)
+	if err = w.recordAndPrune(oldTsDir, generation, digest, "", true); err != nil {
+		klog.Error(err, "unable to record rollback history", "target directory", w.targetDir)
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,270 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"sync"
+	"testing"
+)
+
+// TestRollbackWithSeparateCASRoot is a regression test for Rollback writing
+// the ..data_tmp symlink target as the bare generation name even when the
+// generation is content-addressed and lives under a separately configured
+// CASRoot, which left ..data pointing at a nonexistent path under
+// targetDir instead of the real location under CASRoot.
+func TestRollbackWithSeparateCASRoot(t *testing.T) {
+	targetDir := t.TempDir()
+	casRoot := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{Dedup: true, CASRoot: casRoot, KeepGenerations: 2})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	writePayload := func(content string) {
+		t.Helper()
+		payload := map[string]FileProjection{"config.yaml": {Data: []byte(content), Mode: 0644}}
+		if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+			t.Fatalf("Write(%q): %v", content, err)
+		}
+	}
+
+	writePayload("A")
+	gens, err := w.History()
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	genA := gens[0].Name
+	writePayload("B")
+
+	if err := w.Rollback(genA); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	linkTarget, err := os.Readlink(path.Join(targetDir, dataDirName))
+	if err != nil {
+		t.Fatalf("Readlink(..data): %v", err)
+	}
+	if !path.IsAbs(linkTarget) {
+		t.Fatalf("expected ..data to point at an absolute CASRoot path for a content-addressed generation, got %q", linkTarget)
+	}
+
+	data, err := os.ReadFile(path.Join(targetDir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("ReadFile after rollback: %v", err)
+	}
+	if string(data) != "A" {
+		t.Fatalf("expected rollback to restore content %q, got %q", "A", data)
+	}
+}
+
+// TestRollbackToRetainedGeneration is a regression test for a generation
+// being recorded twice across a Write+Rollback sequence - once as the entry
+// Rollback prepends, once as the already-retained entry still in history -
+// which used to cause the directory the rolled-back-to generation (and
+// ..data) lives in to be deleted out from under the rollback.
+func TestRollbackToRetainedGeneration(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{KeepGenerations: 2})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	writePayload := func(content string) {
+		t.Helper()
+		payload := map[string]FileProjection{"config.yaml": {Data: []byte(content), Mode: 0644}}
+		if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+			t.Fatalf("Write(%q): %v", content, err)
+		}
+	}
+
+	writePayload("A")
+	writePayload("B")
+	gens, err := w.History()
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	genB := gens[0].Name
+	writePayload("C")
+
+	if err := w.Rollback(genB); err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+
+	data, err := os.ReadFile(path.Join(targetDir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("ReadFile after rollback: %v", err)
+	}
+	if string(data) != "B" {
+		t.Fatalf("expected rollback to restore content %q, got %q", "B", data)
+	}
+
+	linkTarget, err := os.Readlink(path.Join(targetDir, dataDirName))
+	if err != nil {
+		t.Fatalf("Readlink(..data): %v", err)
+	}
+	if _, err := os.Stat(path.Join(targetDir, linkTarget)); err != nil {
+		t.Fatalf("..data points at a dangling target %q: %v", linkTarget, err)
+	}
+}
+
+// TestRecordAndPruneDoesNotDoubleReleaseOldGeneration is a regression test
+// for the generation that Write just moved ..data away from being released
+// twice when it also appears in the pruned tail of history.
+func TestRecordAndPruneDoesNotDoubleReleaseOldGeneration(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{KeepGenerations: 1})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	for _, content := range []string{"A", "B", "C"} {
+		payload := map[string]FileProjection{"config.yaml": {Data: []byte(content), Mode: 0644}}
+		if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+			t.Fatalf("Write(%q): %v", content, err)
+		}
+	}
+
+	data, err := os.ReadFile(path.Join(targetDir, "config.yaml"))
+	if err != nil {
+		t.Fatalf("ReadFile: %v", err)
+	}
+	if string(data) != "C" {
+		t.Fatalf("expected final content %q, got %q", "C", data)
+	}
+}
+
+// TestConcurrentWriteAndRollbackRequireCallerSerialization documents that
+// Writer offers no concurrency guarantees of its own (per Writer's package
+// doc): interleaved Write and Rollback calls from multiple goroutines must
+// be serialized by the caller, e.g. with a mutex, for the target directory
+// to end up in a consistent state. This test drives Write and Rollback from
+// separate goroutines behind a shared mutex and asserts the Writer behaves
+// correctly when that contract is honored. KeepGenerations is set high
+// enough that none of this test's handful of generations are pruned, so the
+// assertion exercises lock serialization rather than racing against which
+// goroutine's generation gets pruned first.
+func TestConcurrentWriteAndRollbackRequireCallerSerialization(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{KeepGenerations: 10})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	var mu sync.Mutex
+	write := func(content string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		payload := map[string]FileProjection{"config.yaml": {Data: []byte(content), Mode: 0644}}
+		return w.Write(payload, nil, WriteOptions{})
+	}
+	rollback := func(generation string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return w.Rollback(generation)
+	}
+
+	if err := write("A"); err != nil {
+		t.Fatalf("write A: %v", err)
+	}
+	gens, err := w.History()
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	genA := gens[0].Name
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	wg.Add(4)
+	go func() { defer wg.Done(); errs[0] = write("B") }()
+	go func() { defer wg.Done(); errs[1] = write("C") }()
+	go func() { defer wg.Done(); errs[2] = rollback(genA) }()
+	go func() { defer wg.Done(); errs[3] = write("D") }()
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("operation %d: %v", i, err)
+		}
+	}
+
+	linkTarget, err := os.Readlink(path.Join(targetDir, dataDirName))
+	if err != nil {
+		t.Fatalf("Readlink(..data) after concurrent operations: %v", err)
+	}
+	if _, err := os.Stat(path.Join(targetDir, linkTarget)); err != nil {
+		t.Fatalf("..data points at a dangling target %q after concurrent operations: %v", linkTarget, err)
+	}
+}
+
+// TestHistoryRecoversFromCorruptFile asserts that a corrupt ..history.json
+// doesn't make the Writer unusable: it's treated as an empty history instead
+// of a fatal error, so the Writer can keep operating.
+func TestHistoryRecoversFromCorruptFile(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{KeepGenerations: 2})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	if err := os.WriteFile(w.historyPath(), []byte("{not valid json"), 0644); err != nil {
+		t.Fatalf("seeding corrupt history file: %v", err)
+	}
+
+	payload := map[string]FileProjection{"config.yaml": {Data: []byte("A"), Mode: 0644}}
+	if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write after corrupt history file: %v", err)
+	}
+
+	gens, err := w.History()
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(gens) != 1 {
+		t.Fatalf("expected history to recover to a single fresh generation, got %d", len(gens))
+	}
+}
+
+// TestHistoryRecoversFromMissingFile asserts that a Writer with no
+// ..history.json yet (the common case before any retained generation)
+// behaves as if it started from an empty history.
+func TestHistoryRecoversFromMissingFile(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{KeepGenerations: 2})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	gens, err := w.History()
+	if err != nil {
+		t.Fatalf("History: %v", err)
+	}
+	if len(gens) != 0 {
+		t.Fatalf("expected no generations before any Write, got %d", len(gens))
+	}
+
+	payload := map[string]FileProjection{"config.yaml": {Data: []byte("A"), Mode: 0644}}
+	if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if gens, err = w.History(); err != nil {
+		t.Fatalf("History after Write: %v", err)
+	} else if len(gens) != 1 {
+		t.Fatalf("expected a single generation after one Write, got %d", len(gens))
+	}
+}
@@ -0,0 +1,127 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/klog/v2"
+)
+
+// createLeafSymlinks creates one symlink per payload entry, pointing
+// directly at its leaf file under ..data, instead of symlinking the entry's
+// top-level directory. Any intermediate directories in the target are
+// created with MkdirAll as needed, so a target that already contains
+// user-owned subdirectories can be overlaid with a projected fragment
+// instead of having to hand the whole top-level directory to the Writer.
+//
+// Because the leaf file lives several directories below the target
+// directory, the symlink target is a relative path with enough ".." segments
+// to reach back up to the target directory before descending into ..data.
+func (w *Writer) createLeafSymlinks(payload map[string]FileProjection) error {
+	ps := string(os.PathSeparator)
+	for userVisiblePath := range payload {
+		visibleFile := path.Join(w.targetDir, userVisiblePath)
+		baseDir := filepath.Dir(visibleFile)
+
+		if err := os.MkdirAll(baseDir, os.ModePerm); err != nil {
+			klog.Error(err, "unable to create directory", "directory", baseDir)
+			return err
+		}
+
+		_, err := os.Readlink(visibleFile)
+		if err == nil {
+			// already a symlink (presumably ours, from a previous Write); leave it
+			continue
+		}
+		if !os.IsNotExist(err) {
+			// exists but isn't a symlink; it's user-owned content at a path that
+			// collides with a projected leaf, so leave it untouched
+			continue
+		}
+
+		depth := strings.Count(userVisiblePath, ps)
+		dataDirFile := strings.Repeat(".."+ps, depth) + path.Join(dataDirName, userVisiblePath)
+		if err := os.Symlink(dataDirFile, visibleFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeLeafSymlinks removes leaf symlinks created by createLeafSymlinks for
+// paths no longer present in the payload, and prunes the directories that
+// held them once they're empty. It never descends into, or removes, content
+// that isn't a symlink pointing into ..data, so user-owned files and
+// directories sitting next to projected ones are never touched.
+func (w *Writer) removeLeafSymlinks(paths sets.Set[string]) error {
+	ps := string(os.PathSeparator)
+	candidates := paths.UnsortedList()
+	// process deepest paths first so that directories are considered for
+	// pruning only after the leaf symlinks beneath them are gone
+	sort.Slice(candidates, func(i, j int) bool {
+		return strings.Count(candidates[i], ps) > strings.Count(candidates[j], ps)
+	})
+
+	var lasterr error
+	for _, p := range candidates {
+		full := path.Join(w.targetDir, p)
+		info, err := os.Lstat(full)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			klog.Error(err, "unable to stat old user-visible path", "path", p)
+			lasterr = err
+			continue
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if err := os.Remove(full); err != nil {
+				klog.Error(err, "unable to prune old user-visible leaf symlink", "path", p)
+				lasterr = err
+			}
+			continue
+		}
+
+		if !info.IsDir() {
+			// not ours: leave any user-owned file alone
+			continue
+		}
+
+		entries, err := os.ReadDir(full)
+		if err != nil {
+			klog.Error(err, "unable to read directory while pruning old user-visible paths", "path", p)
+			lasterr = err
+			continue
+		}
+		if len(entries) == 0 {
+			if err := os.Remove(full); err != nil {
+				klog.Error(err, "unable to prune empty directory", "path", p)
+				lasterr = err
+			}
+		}
+		// a non-empty directory still holds user-owned content; leave it be
+	}
+
+	return lasterr
+}
@@ -0,0 +1,101 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"testing"
+)
+
+// TestLeafSymlinksDoesNotTouchUserOwnedFiles writes a projected fragment
+// alongside pre-existing user-owned files and directories, then asserts the
+// projected leaf is symlinked in place while every user-owned path is left
+// completely untouched, including across an update that removes the
+// projected leaf.
+func TestLeafSymlinksDoesNotTouchUserOwnedFiles(t *testing.T) {
+	targetDir := t.TempDir()
+
+	// pre-existing user-owned content that happens to live next to (and
+	// share a parent directory with) what will be projected
+	if err := os.MkdirAll(path.Join(targetDir, "etc", "app"), 0755); err != nil {
+		t.Fatalf("seeding user-owned directory: %v", err)
+	}
+	userFile := path.Join(targetDir, "etc", "app", "user.conf")
+	if err := os.WriteFile(userFile, []byte("user-owned"), 0644); err != nil {
+		t.Fatalf("seeding user-owned file: %v", err)
+	}
+
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{LeafSymlinks: true})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+
+	payload := map[string]FileProjection{
+		"etc/app/projected.conf": {Data: []byte("projected-v1"), Mode: 0644},
+	}
+	if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	assertUserFileUntouched := func() {
+		t.Helper()
+		info, err := os.Lstat(userFile)
+		if err != nil {
+			t.Fatalf("Lstat(user.conf): %v", err)
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			t.Fatal("user-owned file was replaced with a symlink")
+		}
+		data, err := os.ReadFile(userFile)
+		if err != nil {
+			t.Fatalf("ReadFile(user.conf): %v", err)
+		}
+		if string(data) != "user-owned" {
+			t.Fatalf("user-owned file content changed: %q", data)
+		}
+	}
+	assertUserFileUntouched()
+
+	projectedFile := path.Join(targetDir, "etc", "app", "projected.conf")
+	info, err := os.Lstat(projectedFile)
+	if err != nil {
+		t.Fatalf("Lstat(projected.conf): %v", err)
+	}
+	if info.Mode()&os.ModeSymlink == 0 {
+		t.Fatal("expected projected.conf to be a leaf symlink")
+	}
+	data, err := os.ReadFile(projectedFile)
+	if err != nil {
+		t.Fatalf("ReadFile(projected.conf): %v", err)
+	}
+	if string(data) != "projected-v1" {
+		t.Fatalf("expected projected-v1, got %q", data)
+	}
+
+	// update the projection to remove the leaf entirely; the user-owned
+	// sibling file and the now-empty-of-projected-content directory it
+	// shares with the projection must still be left alone
+	if err := w.Write(map[string]FileProjection{}, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write (removal): %v", err)
+	}
+
+	if _, err := os.Lstat(projectedFile); !os.IsNotExist(err) {
+		t.Fatalf("expected projected.conf to be removed, got err=%v", err)
+	}
+	assertUserFileUntouched()
+}
@@ -0,0 +1,46 @@
+//go:build windows
+
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// lockRefsFile approximates an exclusive lock on Windows, where flock(2)
+// isn't available, by spinning on exclusive creation of a lock file. The
+// returned function releases the lock (by removing the lock file) and must
+// always be called.
+func lockRefsFile(dir string) (func(), error) {
+	lockPath := path.Join(dir, casLockName)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0644)
+		if err == nil {
+			return func() {
+				f.Close()
+				os.Remove(lockPath)
+			}, nil
+		}
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
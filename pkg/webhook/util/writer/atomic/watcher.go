@@ -0,0 +1,299 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/klog/v2"
+)
+
+// defaultPollInterval is the fallback poll period used when fsnotify isn't
+// available on the current platform.
+const defaultPollInterval = 1 * time.Second
+
+// Event describes a new generation observed on the ..data symlink of a
+// target directory.
+type Event struct {
+	// Generation is the name of the timestamped (or content-addressed)
+	// directory that ..data now points at.
+	Generation string
+	// Payload is the rebuilt contents of that directory, keyed by the same
+	// relative paths that were originally passed to Writer.Write.
+	Payload map[string]FileProjection
+}
+
+// Watcher observes a target directory managed by a Writer and emits an Event
+// each time the ..data symlink is repointed at a new generation.
+//
+// Watcher is built on fsnotify where available, and falls back to polling
+// os.Readlink on platforms (namely Windows, where Write uses Remove+Symlink
+// instead of a single atomic rename) where watching a symlink rename isn't
+// reliable.
+type Watcher struct {
+	targetDir string
+	debounce  time.Duration
+
+	events chan Event
+	stopCh chan struct{}
+	wg     sync.WaitGroup
+
+	mu  sync.Mutex
+	cur Event
+}
+
+// NewWatcher creates a Watcher for the given target directory and starts its
+// background goroutine. debounce coalesces rapid sequential writes into a
+// single emitted Event; a value of 0 disables debouncing.
+func NewWatcher(targetDir string, debounce time.Duration) (*Watcher, error) {
+	w := &Watcher{
+		targetDir: targetDir,
+		debounce:  debounce,
+		events:    make(chan Event, 1),
+		stopCh:    make(chan struct{}),
+	}
+
+	cur, err := w.readCurrent()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	w.mu.Lock()
+	w.cur = cur
+	w.mu.Unlock()
+
+	if runtime.GOOS == "windows" {
+		w.wg.Add(1)
+		go w.runPollLoop()
+		return w, nil
+	}
+
+	fsWatcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		klog.Error(err, "unable to create fsnotify watcher, falling back to polling", "directory", targetDir)
+		w.wg.Add(1)
+		go w.runPollLoop()
+		return w, nil
+	}
+	if err := fsWatcher.Add(targetDir); err != nil {
+		fsWatcher.Close()
+		klog.Error(err, "unable to watch target directory, falling back to polling", "directory", targetDir)
+		w.wg.Add(1)
+		go w.runPollLoop()
+		return w, nil
+	}
+
+	w.wg.Add(1)
+	go w.runFsnotifyLoop(fsWatcher)
+
+	return w, nil
+}
+
+// Current synchronously returns the generation observed at Watcher creation
+// time (or the most recently observed one), without waiting on the event
+// channel.
+func (w *Watcher) Current() (Event, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.cur, nil
+}
+
+// Events returns the channel on which new generations are delivered.
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Close stops the Watcher's background goroutine. It does not close the
+// Events channel, since a send may still be in flight; callers should stop
+// reading from it after Close returns.
+func (w *Watcher) Close() error {
+	close(w.stopCh)
+	w.wg.Wait()
+	return nil
+}
+
+func (w *Watcher) runFsnotifyLoop(fsWatcher *fsnotify.Watcher) {
+	defer w.wg.Done()
+	defer fsWatcher.Close()
+
+	var debounceTimer *time.Timer
+	var debounceCh <-chan time.Time
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case err, ok := <-fsWatcher.Errors:
+			if !ok {
+				return
+			}
+			klog.Error(err, "fsnotify watcher error", "directory", w.targetDir)
+		case ev, ok := <-fsWatcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(ev.Name) != dataDirName {
+				continue
+			}
+			if ev.Op&(fsnotify.Create|fsnotify.Rename) == 0 {
+				continue
+			}
+			if w.debounce <= 0 {
+				w.emitCurrent()
+				continue
+			}
+			if debounceTimer == nil {
+				debounceTimer = time.NewTimer(w.debounce)
+			} else {
+				if !debounceTimer.Stop() {
+					<-debounceTimer.C
+				}
+				debounceTimer.Reset(w.debounce)
+			}
+			debounceCh = debounceTimer.C
+		case <-debounceCh:
+			debounceCh = nil
+			w.emitCurrent()
+		}
+	}
+}
+
+func (w *Watcher) runPollLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(defaultPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+			w.emitIfChanged()
+		}
+	}
+}
+
+// emitCurrent reads the current generation and always sends it, used after
+// an fsnotify event has already told us something changed.
+func (w *Watcher) emitCurrent() {
+	ev, err := w.readCurrent()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Error(err, "unable to read current generation", "directory", w.targetDir)
+		}
+		return
+	}
+	w.mu.Lock()
+	w.cur = ev
+	w.mu.Unlock()
+	w.send(ev)
+}
+
+// emitIfChanged reads the current generation and only sends it if it differs
+// from the last observed one, used by the poll-loop fallback.
+func (w *Watcher) emitIfChanged() {
+	ev, err := w.readCurrent()
+	if err != nil {
+		if !os.IsNotExist(err) {
+			klog.Error(err, "unable to read current generation", "directory", w.targetDir)
+		}
+		return
+	}
+
+	w.mu.Lock()
+	changed := ev.Generation != w.cur.Generation
+	w.cur = ev
+	w.mu.Unlock()
+
+	if changed {
+		w.send(ev)
+	}
+}
+
+func (w *Watcher) send(ev Event) {
+	select {
+	case w.events <- ev:
+	case <-w.stopCh:
+	}
+}
+
+// readCurrent resolves the ..data symlink and rebuilds the payload of the
+// generation it currently points at.
+func (w *Watcher) readCurrent() (Event, error) {
+	dataDirPath := path.Join(w.targetDir, dataDirName)
+	tsDirName, err := os.Readlink(dataDirPath)
+	if err != nil {
+		return Event{}, err
+	}
+
+	// tsDirName is a bare name relative to targetDir unless it's a
+	// content-addressed generation living under a separately configured
+	// CASRoot, in which case it's already an absolute path; a bare
+	// path.Join would silently concatenate the two and walk a bogus
+	// directory instead of erroring.
+	payload, err := readPayloadFromDir(resolveDataDirTarget(w.targetDir, tsDirName))
+	if err != nil {
+		return Event{}, err
+	}
+
+	return Event{Generation: tsDirName, Payload: payload}, nil
+}
+
+// readPayloadFromDir walks a generation directory back into a payload map,
+// restoring the mode bits that were originally written by writePayloadToDir.
+func readPayloadFromDir(dir string) (map[string]FileProjection, error) {
+	payload := make(map[string]FileProjection)
+	err := filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if p == dir || info.IsDir() {
+			return nil
+		}
+		relativePath := strings.TrimPrefix(p, dir)
+		relativePath = strings.TrimPrefix(relativePath, string(os.PathSeparator))
+		if relativePath == casRefsName || relativePath == casLockName {
+			return nil
+		}
+
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		payload[relativePath] = FileProjection{Data: data, Mode: int32(info.Mode().Perm())}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return payload, nil
+}
+
+// Integration note: Watcher itself is the hot-reload hook - a GameServer
+// sidecar constructs one against the same target directory the in-cluster
+// controller projects into and reacts to Events as they arrive instead of
+// polling the filesystem itself. This package does not include any sidecar
+// binary or GameServer controller wiring (none exists in this tree); a
+// sidecar that wants the hook imports this package and calls NewWatcher
+// directly, the same way any other caller in this repo would.
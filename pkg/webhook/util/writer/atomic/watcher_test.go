@@ -0,0 +1,158 @@
+/*
+Copyright 2020 The Kruise Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package atomic
+
+import (
+	"testing"
+	"time"
+)
+
+// TestWatcherCurrentWithSeparateCASRoot is a regression test for
+// readCurrent resolving a content-addressed generation under a separately
+// configured CASRoot with a bare path.Join, which silently produced a
+// bogus path and an Event with an empty Payload instead of an error.
+func TestWatcherCurrentWithSeparateCASRoot(t *testing.T) {
+	targetDir := t.TempDir()
+	casRoot := t.TempDir()
+	w, err := NewAtomicWriterWithOptions(targetDir, Options{Dedup: true, CASRoot: casRoot})
+	if err != nil {
+		t.Fatalf("NewAtomicWriterWithOptions: %v", err)
+	}
+	if err := w.Write(map[string]FileProjection{"a": {Data: []byte("1"), Mode: 0644}}, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	watcher, err := NewWatcher(targetDir, 0)
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer watcher.Close()
+
+	ev, err := watcher.Current()
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	if len(ev.Payload) == 0 {
+		t.Fatal("Current returned an empty Payload for a generation stored under a separate CASRoot")
+	}
+	if string(ev.Payload["a"].Data) != "1" {
+		t.Fatalf("expected payload %q, got %q", "1", ev.Payload["a"].Data)
+	}
+}
+
+// TestWatcherCurrentReflectsInitialGeneration asserts that Current() returns
+// the generation already on disk at Watcher creation time, without waiting
+// on the event channel.
+func TestWatcherCurrentReflectsInitialGeneration(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriter(targetDir)
+	if err != nil {
+		t.Fatalf("NewAtomicWriter: %v", err)
+	}
+	payload := map[string]FileProjection{"a": {Data: []byte("1"), Mode: 0644}}
+	if err := w.Write(payload, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	watcher, err := NewWatcher(targetDir, 0)
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer watcher.Close()
+
+	ev, err := watcher.Current()
+	if err != nil {
+		t.Fatalf("Current: %v", err)
+	}
+	if string(ev.Payload["a"].Data) != "1" {
+		t.Fatalf("expected Current to reflect the generation written before NewWatcher, got %q", ev.Payload["a"].Data)
+	}
+}
+
+// TestWatcherEmitsOnWrite asserts that a Watcher emits an Event carrying the
+// new payload each time Write repoints ..data.
+func TestWatcherEmitsOnWrite(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriter(targetDir)
+	if err != nil {
+		t.Fatalf("NewAtomicWriter: %v", err)
+	}
+
+	watcher, err := NewWatcher(targetDir, 0)
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer watcher.Close()
+
+	if err := w.Write(map[string]FileProjection{"a": {Data: []byte("1"), Mode: 0644}}, nil, WriteOptions{}); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	select {
+	case ev := <-watcher.Events():
+		if string(ev.Payload["a"].Data) != "1" {
+			t.Fatalf("expected payload %q, got %q", "1", ev.Payload["a"].Data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for Watcher to emit an Event after Write")
+	}
+}
+
+// TestWatcherDebounceCoalescesRapidWrites asserts that several Writes within
+// the debounce window collapse into a single emitted Event carrying the
+// latest generation, rather than one Event per Write.
+func TestWatcherDebounceCoalescesRapidWrites(t *testing.T) {
+	targetDir := t.TempDir()
+	w, err := NewAtomicWriter(targetDir)
+	if err != nil {
+		t.Fatalf("NewAtomicWriter: %v", err)
+	}
+
+	watcher, err := NewWatcher(targetDir, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("NewWatcher: %v", err)
+	}
+	defer watcher.Close()
+
+	for i := 0; i < 3; i++ {
+		data := []byte{byte('0' + i)}
+		if err := w.Write(map[string]FileProjection{"a": {Data: data, Mode: 0644}}, nil, WriteOptions{}); err != nil {
+			t.Fatalf("Write %d: %v", i, err)
+		}
+	}
+
+	var got []string
+	timeout := time.After(2 * time.Second)
+collect:
+	for {
+		select {
+		case ev := <-watcher.Events():
+			got = append(got, string(ev.Payload["a"].Data))
+		case <-time.After(500 * time.Millisecond):
+			break collect
+		case <-timeout:
+			break collect
+		}
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected debounce to coalesce 3 rapid writes into 1 event, got %d: %v", len(got), got)
+	}
+	if got[0] != "2" {
+		t.Fatalf("expected the coalesced event to carry the latest generation %q, got %q", "2", got[0])
+	}
+}